@@ -0,0 +1,204 @@
+package ahrs
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	G = 9.80665 // Standard gravity, m/s^2; A1..A3 and Z1..Z3 are expressed in g
+)
+
+// Measurement is one synchronized reading from the sensors an AHRSProvider
+// consumes: gyro, accelerometer, magnetometer, and (optionally) GPS
+// velocity, all timestamped against a common clock.
+type Measurement struct {
+	T float64 // Timestamp, s
+
+	A1, A2, A3 float64 // Accelerometer reading, g, body frame
+	B1, B2, B3 float64 // Gyro rate, rad/s, body frame
+
+	M1, M2, M3 float64 // Magnetometer reading, body frame
+	MValid     bool
+
+	W1, W2, W3 float64 // GPS velocity, m/s, earth frame
+	WValid     bool
+}
+
+// State holds the orientation estimate common to every AHRSProvider
+// implementation in this package. Algorithm-specific state (gains, bias
+// estimates, moving averages, ...) lives on the embedding type instead.
+type State struct {
+	E0, E1, E2, E3 float64 // Orientation quaternion, body frame to earth frame
+	T              float64 // Timestamp of the last Compute(), s
+}
+
+// AHRSProvider is implemented by every orientation-estimation algorithm in
+// this package, letting callers swap filters without touching downstream
+// code.
+type AHRSProvider interface {
+	Compute(m *Measurement)
+	Valid() bool
+	CalcRollPitchHeading() (roll float64, pitch float64, heading float64)
+	CalcRollPitchHeadingUncertainty() (droll float64, dpitch float64, dheading float64)
+}
+
+// Capabilities describes what a filter needs to run and what it can be
+// tuned with, so callers can pick an algorithm appropriate to the sensors
+// they actually have.
+type Capabilities struct {
+	RequiresGyro  bool
+	RequiresAccel bool
+	RequiresMag   bool
+	RequiresGPS   bool
+	Params        []string // Names of exported tuning fields, e.g. "Beta", "Kp"
+}
+
+// CapableState is implemented by providers that can describe their own
+// requirements and tuning parameters.
+type CapableState interface {
+	Capabilities() Capabilities
+}
+
+// registry lists the algorithms this package actually implements.
+// "simple" and "kalman" are not registered: no such filters exist in this
+// package yet, so NewState deliberately reports them as unknown rather than
+// silently returning something else.
+var registry = map[string]func(m *Measurement) AHRSProvider{
+	"heuristic": func(m *Measurement) AHRSProvider { return InitializeHeuristic(m) },
+	"madgwick":  func(m *Measurement) AHRSProvider { return InitializeMadgwick(m) },
+	"mahony":    func(m *Measurement) AHRSProvider { return InitializeMahony(m) },
+}
+
+// NewState constructs the named AHRS algorithm, initialized from m.
+func NewState(name string, m *Measurement) (AHRSProvider, error) {
+	ctor, ok := registry[name]
+	if !ok {
+		return nil, fmt.Errorf("ahrs: unknown algorithm %q", name)
+	}
+	return ctor(m), nil
+}
+
+// ShootoutResult holds one algorithm's output over a recorded measurement
+// log, for comparing filters against each other.
+type ShootoutResult struct {
+	Name                 string
+	Roll, Pitch, Heading []float64
+	Elapsed              time.Duration
+}
+
+// RunShootout replays log through each named algorithm in turn and returns
+// its roll/pitch/heading traces along with the wall-clock time taken to
+// process the whole log.
+func RunShootout(names []string, log []Measurement) ([]ShootoutResult, error) {
+	if len(log) == 0 {
+		return nil, fmt.Errorf("ahrs: empty measurement log")
+	}
+
+	results := make([]ShootoutResult, 0, len(names))
+	for _, name := range names {
+		s, err := NewState(name, &log[0])
+		if err != nil {
+			return nil, err
+		}
+
+		roll := make([]float64, len(log))
+		pitch := make([]float64, len(log))
+		heading := make([]float64, len(log))
+
+		start := time.Now()
+		for i := range log {
+			s.Compute(&log[i])
+			roll[i], pitch[i], heading[i] = s.CalcRollPitchHeading()
+		}
+		elapsed := time.Since(start)
+
+		results = append(results, ShootoutResult{
+			Name:    name,
+			Roll:    roll,
+			Pitch:   pitch,
+			Heading: heading,
+			Elapsed: elapsed,
+		})
+	}
+
+	return results, nil
+}
+
+// QuaternionAToB returns the quaternion that rotates vector a=(a1,a2,a3)
+// onto vector b=(b1,b2,b3); neither needs to be normalized. The rotation
+// about the a/b axis itself is left undetermined, as with any two-vector
+// alignment, so callers that care about that degree of freedom (as
+// HeuristicState does) resolve it separately.
+func QuaternionAToB(a1, a2, a3, b1, b2, b3 float64) (q0, q1, q2, q3 float64) {
+	an := math.Sqrt(a1*a1 + a2*a2 + a3*a3)
+	bn := math.Sqrt(b1*b1 + b2*b2 + b3*b3)
+	if an == 0 || bn == 0 {
+		return 1, 0, 0, 0
+	}
+	a1, a2, a3 = a1/an, a2/an, a3/an
+	b1, b2, b3 = b1/bn, b2/bn, b3/bn
+
+	dot := a1*b1 + a2*b2 + a3*b3
+	x1, x2, x3 := a2*b3-a3*b2, a3*b1-a1*b3, a1*b2-a2*b1
+	xn := math.Sqrt(x1*x1 + x2*x2 + x3*x3)
+
+	if xn < 1e-12 {
+		if dot > 0 {
+			// a and b already point the same way: no rotation needed
+			return 1, 0, 0, 0
+		}
+		// a and b are antiparallel: rotate 180 degrees about any axis
+		// perpendicular to a
+		px1, px2, px3 := 1.0, 0.0, 0.0
+		if math.Abs(a1) > 0.9 {
+			px1, px2, px3 = 0, 1, 0
+		}
+		x1, x2, x3 = a2*px3-a3*px2, a3*px1-a1*px3, a1*px2-a2*px1
+		xn = math.Sqrt(x1*x1 + x2*x2 + x3*x3)
+		return 0, x1 / xn, x2 / xn, x3 / xn
+	}
+
+	if dot > 1 {
+		dot = 1
+	} else if dot < -1 {
+		dot = -1
+	}
+	angle := math.Acos(dot)
+	sa, ca := math.Sin(angle/2), math.Cos(angle/2)
+	return ca, sa * x1 / xn, sa * x2 / xn, sa * x3 / xn
+}
+
+// FromQuaternion converts an orientation quaternion to roll, pitch, and
+// heading (yaw), in radians, using the standard aerospace ZYX Euler
+// sequence.
+func FromQuaternion(q0, q1, q2, q3 float64) (roll float64, pitch float64, heading float64) {
+	roll = math.Atan2(2*(q0*q1+q2*q3), 1-2*(q1*q1+q2*q2))
+
+	sinp := 2 * (q0*q2 - q3*q1)
+	if sinp > 1 {
+		sinp = 1
+	} else if sinp < -1 {
+		sinp = -1
+	}
+	pitch = math.Asin(sinp)
+
+	heading = math.Atan2(2*(q0*q3+q1*q2), 1-2*(q2*q2+q3*q3))
+	return
+}
+
+// ToQuaternion is the inverse of FromQuaternion: it builds the orientation
+// quaternion for the given roll, pitch, and heading (radians), using the
+// same aerospace ZYX Euler sequence.
+func ToQuaternion(roll, pitch, heading float64) (q0, q1, q2, q3 float64) {
+	cr, sr := math.Cos(roll/2), math.Sin(roll/2)
+	cp, sp := math.Cos(pitch/2), math.Sin(pitch/2)
+	ch, sh := math.Cos(heading/2), math.Sin(heading/2)
+
+	q0 = ch*cp*cr + sh*sp*sr
+	q1 = ch*cp*sr - sh*sp*cr
+	q2 = ch*sp*cr + sh*cp*sr
+	q3 = sh*cp*cr - ch*sp*sr
+	return
+}
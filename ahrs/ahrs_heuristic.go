@@ -5,33 +5,63 @@ import (
 )
 
 const (
-	KSHORT = 0.2	// Decay time for short-term moving average, 0.5s
-	KLONG  = 0.02	// Decay time for long-term moving average, 5s
+	KSHORT = 0.2  // Decay time for short-term moving average, 0.5s
+	KLONG  = 0.02 // Decay time for long-term moving average, 5s
+
+	DefaultKcog           = 0.05 // Slow complementary blend: GPS track is noisy at low rates
+	DefaultCogMinSpeed    = 5    // m/s; below this GPS track is too noisy to trust
+	DefaultCogFreezeSpeed = 1    // m/s; below this we stop correcting yaw at all
+
+	stationaryAccelTol = 0.05 // |a|-1g tolerance (g) to call the airplane at rest
+	stationaryGyroTol  = 0.2  // Raw gyro tolerance (rad/s) to rule out an actual turn, not just bias
 )
 
 type HeuristicState struct {
-			State
-	Inertial	bool
-	HeadingValid    bool
-	Z1, Z2, Z3      float64
-
-	W10, W20, W30   float64
-	W1S, W2S, W3S	float64
-	W1L, W2L, W3L	float64
-	A1S, A2S, A3S	float64
-	A1L, A2L, A3L	float64
-	B1S, B2S, B3S	float64
-	B1L, B2L, B3L	float64
-	M1S, M2S, M3S	float64
-	M1L, M2L, M3L	float64
+	State
+	Inertial     bool
+	HeadingValid bool
+	Z1, Z2, Z3   float64
+
+	W10, W20, W30 float64
+	W1S, W2S, W3S float64
+	W1L, W2L, W3L float64
+	A1S, A2S, A3S float64
+	A1L, A2L, A3L float64
+	B1S, B2S, B3S float64
+	B1L, B2L, B3L float64
+	M1S, M2S, M3S float64
+	M1L, M2L, M3L float64
+
+	Declination float64 // Local magnetic declination, radians east of true north
+
+	Kcog           float64 // Complementary gain blending GPS course-over-ground into heading
+	CogMinSpeed    float64 // Groundspeed (m/s) above which course-over-ground is trusted
+	CogFreezeSpeed float64 // Groundspeed (m/s) below which the yaw reference is frozen
+
+	GyroBias1, GyroBias2, GyroBias3 float64 // Estimated gyro bias, rad/s; recalibrated while stationary, subtracted from the yaw rate used to coast heading during GPS dropouts
+}
+
+// SetMagDeclination sets the local magnetic declination (the angle between
+// true north and magnetic north), in degrees east of true north, used to
+// correct the magnetometer-derived heading.
+func (s *HeuristicState) SetMagDeclination(deg float64) {
+	s.Declination = deg * math.Pi / 180
 }
 
 func InitializeHeuristic(m *Measurement) (s *HeuristicState) {
 	s = new(HeuristicState)
+	s.Kcog = DefaultKcog
+	s.CogMinSpeed = DefaultCogMinSpeed
+	s.CogFreezeSpeed = DefaultCogFreezeSpeed
+	s.E0 = 1
+	s.T = m.T
 	return s
 }
 
 func (s *HeuristicState) Compute(m *Measurement) {
+	dt := m.T - s.T
+	_, _, lastHeading := s.CalcRollPitchHeading()
+
 	if m.WValid {
 		if s.W10 == 0 && s.W20 == 0 && s.W30 == 0 {
 			// Startup: don't overdo acceleration
@@ -41,25 +71,58 @@ func (s *HeuristicState) Compute(m *Measurement) {
 		}
 
 		// Update moving averages
-		s.W1S = KSHORT * m.W1 + (1 - KSHORT) * s.W1S
-		s.W2S = KSHORT * m.W2 + (1 - KSHORT) * s.W2S
-		s.W3S = KSHORT * m.W3 + (1 - KSHORT) * s.W3S
+		s.W1S = KSHORT*m.W1 + (1-KSHORT)*s.W1S
+		s.W2S = KSHORT*m.W2 + (1-KSHORT)*s.W2S
+		s.W3S = KSHORT*m.W3 + (1-KSHORT)*s.W3S
+		s.W1L = KLONG*m.W1 + (1-KLONG)*s.W1L
+		s.W2L = KLONG*m.W2 + (1-KLONG)*s.W2L
+		s.W3L = KLONG*m.W3 + (1-KLONG)*s.W3L
 
 		// Compute instantaneous accelerations from GPS (Earth frame)
-		// This is what makes the sensor frame non-inertial
-		s.Z1 = KSHORT * (m.W1 - s.W10) / (m.T - s.T) / G + (1 - KSHORT) * s.Z1
-		s.Z2 = KSHORT * (m.W2 - s.W20) / (m.T - s.T) / G + (1 - KSHORT) * s.Z2
-		s.Z3 = KSHORT * (m.W3 - s.W30) / (m.T - s.T) / G + (1 - KSHORT) * s.Z3
+		// This is what makes the sensor frame non-inertial. Guard against a
+		// repeated or out-of-order timestamp: dividing by a zero or negative
+		// dt would poison Z1..Z3 with Inf/NaN that never recovers.
+		if dt > 0 {
+			s.Z1 = KSHORT*(m.W1-s.W10)/dt/G + (1-KSHORT)*s.Z1
+			s.Z2 = KSHORT*(m.W2-s.W20)/dt/G + (1-KSHORT)*s.Z2
+			s.Z3 = KSHORT*(m.W3-s.W30)/dt/G + (1-KSHORT)*s.Z3
+		}
 	} else {
+		// No GPS: let the moving averages and inferred accelerations decay
+		// smoothly towards zero rather than snapping, so a momentary GPS
+		// dropout doesn't show up as a step in the orientation estimate.
 		s.W10 = 0
 		s.W20 = 0
 		s.W30 = 0
-		s.W1S = 0
-		s.W2S = 0
-		s.W3S = 0
-		s.Z1 = 0
-		s.Z2 = 0
-		s.Z3 = 0
+		s.W1S *= 1 - KSHORT
+		s.W2S *= 1 - KSHORT
+		s.W3S *= 1 - KSHORT
+		s.W1L *= 1 - KLONG
+		s.W2L *= 1 - KLONG
+		s.W3L *= 1 - KLONG
+		s.Z1 *= 1 - KSHORT
+		s.Z2 *= 1 - KSHORT
+		s.Z3 *= 1 - KSHORT
+	}
+
+	// Detect a stationary aircraft (no groundspeed, 1g on the accelerometer,
+	// no raw gyro rate large enough to be an actual turn) and use it to
+	// recalibrate gyro bias: any rate reported while sitting still and
+	// unaccelerated is pure bias, not real rotation. The long-term velocity
+	// average is used rather than the instantaneous GPS fix, and the raw
+	// (not bias-corrected) gyro rate is checked against a generous
+	// threshold, so a single noisy sample can't trigger or break detection
+	// and the check doesn't depend on the very bias it's estimating.
+	if m.WValid {
+		groundspeedL := math.Sqrt(s.W1L*s.W1L + s.W2L*s.W2L + s.W3L*s.W3L)
+		accelNorm := math.Sqrt(m.A1*m.A1 + m.A2*m.A2 + m.A3*m.A3)
+		gyroNorm := math.Sqrt(m.B1*m.B1 + m.B2*m.B2 + m.B3*m.B3)
+
+		if groundspeedL < s.CogFreezeSpeed && math.Abs(accelNorm-1) < stationaryAccelTol && gyroNorm < stationaryGyroTol {
+			s.GyroBias1 = KLONG*m.B1 + (1-KLONG)*s.GyroBias1
+			s.GyroBias2 = KLONG*m.B2 + (1-KLONG)*s.GyroBias2
+			s.GyroBias3 = KLONG*m.B3 + (1-KLONG)*s.GyroBias3
+		}
 	}
 
 	// Now, subtract earth-frame accel from gravity to get total accel in earth frame
@@ -72,8 +135,10 @@ func (s *HeuristicState) Compute(m *Measurement) {
 	q0, q1, q2, q3 := QuaternionAToB(ae1, ae2, ae3, m.A1, m.A2, m.A3)
 
 	// This is degenerate for rotations around ae, so remove that ambiguity by
-	// minimizing difference between sensor orientation and GPS track if we have GPS
-	// or just point north if no GPS
+	// minimizing difference between sensor orientation and GPS track if we
+	// have GPS, or by holding the previous heading steady if we don't: a
+	// fixed "just point north" reference would snap the heading to north
+	// the instant GPS dropped out.
 
 	var we1, we2, we3 float64
 	if m.WValid {
@@ -82,34 +147,41 @@ func (s *HeuristicState) Compute(m *Measurement) {
 		we2 = s.W2S / ww
 		we3 = s.W3S / ww
 	} else {
-		we1 = 0
-		we2 = 1
-		we3 = 0
+		we1 = 1 - 2*(s.E2*s.E2+s.E3*s.E3)
+		we2 = 2 * (s.E1*s.E2 + s.E0*s.E3)
+		we3 = 2 * (s.E1*s.E3 - s.E0*s.E2)
+	}
+	if math.IsNaN(we1) {
+		// Zero smoothed velocity gives no track direction: hold the previous
+		// heading as in the no-GPS case.
+		we1 = 1 - 2*(s.E2*s.E2+s.E3*s.E3)
+		we2 = 2 * (s.E1*s.E2 + s.E0*s.E3)
+		we3 = 2 * (s.E1*s.E3 - s.E0*s.E2)
 	}
 
 	// Compute sensor forward direction in earth frame
-	xe1 := 1 - 2 * (q3 * q3 + q2 * q2)
-	xe2 := 2 * (q0 * q3 + q1 * q2)
-	xe3 := 2 * (q1 * q3 - q0 * q2)
+	xe1 := 1 - 2*(q3*q3+q2*q2)
+	xe2 := 2 * (q0*q3 + q1*q2)
+	xe3 := 2 * (q1*q3 - q0*q2)
 
 	// Now the angle to rotate around ae to minimize diff:
 	// Construct a vector perpendicular to ae and xe:
-	u1 := ae2 * xe3 - ae3 * xe2
-	u2 := ae3 * xe1 - ae1 * xe3
-	u3 := ae1 * xe2 - ae2 * xe1
-	uu := math.Sqrt(u1 * u1 + u2 * u2 + u3 * u3)
+	u1 := ae2*xe3 - ae3*xe2
+	u2 := ae3*xe1 - ae1*xe3
+	u3 := ae1*xe2 - ae2*xe1
+	uu := math.Sqrt(u1*u1 + u2*u2 + u3*u3)
 	u1 /= uu
 	u2 /= uu
 	u3 /= uu
 	// Construct a vector perpendicular to ae and we:
-	v1 := ae2 * we3 - ae3 * we2
-	v2 := ae3 * we1 - ae1 * we3
-	v3 := ae1 * we2 - ae2 * we1
-	vv := math.Sqrt(u1 * u1 + u2 * u2 + u3 * u3)
+	v1 := ae2*we3 - ae3*we2
+	v2 := ae3*we1 - ae1*we3
+	v3 := ae1*we2 - ae2*we1
+	vv := math.Sqrt(v1*v1 + v2*v2 + v3*v3)
 	v1 /= vv
 	v2 /= vv
 	v3 /= vv
-	alpha := math.Acos(u1 * v1 + u2 * v2 + u3 * v3)
+	alpha := math.Acos(u1*v1 + u2*v2 + u3*v3)
 
 	// Update the qea quaternion by rotating around ae with this angle
 	// Construct ae rotation quaternion:
@@ -119,10 +191,10 @@ func (s *HeuristicState) Compute(m *Measurement) {
 	p2 := sa * ae2
 	p3 := sa * ae3
 	// Rotate qae to get our final orientation quaternion:
-	s.E0 = p0 * q0 - p1 * q1 - p2 * p2 - p3 * q3
-	s.E1 = p0 * q1 + p1 * q0 + p2 * q3 - p3 * q2
-	s.E2 = p0 * q2 - p1 * q3 + p2 * q0 + p3 * q1
-	s.E3 = p0 * q3 + p1 * q2 - p2 * q1 + p3 * q0
+	s.E0 = p0*q0 - p1*q1 - p2*q2 - p3*q3
+	s.E1 = p0*q1 + p1*q0 + p2*q3 - p3*q2
+	s.E2 = p0*q2 - p1*q3 + p2*q0 + p3*q1
+	s.E3 = p0*q3 + p1*q2 - p2*q1 + p3*q0
 
 	// Save the current GPS speeds for next loop
 	s.W10 = m.W1
@@ -130,17 +202,107 @@ func (s *HeuristicState) Compute(m *Measurement) {
 	s.W30 = m.W3
 	s.T = m.T
 
-	if m.MValid { //TODO westphae: could do more here to get a better Fn since we know N points north
-		s.N1 = m.M1*s.e11 + m.M2*s.e12 + m.M3*s.e13
-		s.N2 = m.M1*s.e21 + m.M2*s.e22 + m.M3*s.e23
-		s.N3 = m.M1*s.e31 + m.M2*s.e32 + m.M3*s.e33
+	s.Inertial = !m.WValid
+	if !m.WValid && dt > 0 {
+		// No GPS to aid yaw: coast heading on the bias-corrected gyro
+		// yaw rate instead of leaving it to free-run on accel/mag noise.
+		psi := (m.B3 - s.GyroBias3) * dt
+		s.E0, s.E1, s.E2, s.E3 = rotateYaw(s.E0, s.E1, s.E2, s.E3, psi)
+	}
+
+	// Below CogFreezeSpeed, neither the GPS course nor the mag-derived
+	// heading below is trustworthy, so frozen is resolved once up front and
+	// used to skip the mag correction entirely: it would just be overwritten
+	// by the freeze at the end anyway.
+	frozen := false
+	if m.WValid {
+		groundspeed := math.Sqrt(m.W1*m.W1 + m.W2*m.W2)
+		frozen = groundspeed < s.CogFreezeSpeed
+
+		if groundspeed > s.CogMinSpeed {
+			// Blend in GPS course-over-ground as a slow correction to the
+			// heading derived from accel; this is the only yaw reference we
+			// have that doesn't depend on magnetometer calibration.
+			_, _, heading := s.CalcRollPitchHeading()
+			cog := math.Atan2(m.W2, m.W1)
+
+			dPsi := cog - heading
+			for dPsi > math.Pi {
+				dPsi -= 2 * math.Pi
+			}
+			for dPsi < -math.Pi {
+				dPsi += 2 * math.Pi
+			}
+
+			psi := s.Kcog * dPsi
+			s.E0, s.E1, s.E2, s.E3 = rotateYaw(s.E0, s.E1, s.E2, s.E3, psi)
+		}
+	}
+
+	if m.MValid && !frozen {
+		// Rotate the measured mag vector into the earth frame with the
+		// orientation just derived from accel/GPS, and discard the vertical
+		// component: tilt doesn't affect heading once we're in earth frame.
+		me1 := (1-2*(s.E2*s.E2+s.E3*s.E3))*m.M1 + 2*(s.E1*s.E2-s.E0*s.E3)*m.M2 + 2*(s.E1*s.E3+s.E0*s.E2)*m.M3
+		me2 := 2*(s.E1*s.E2+s.E0*s.E3)*m.M1 + (1-2*(s.E1*s.E1+s.E3*s.E3))*m.M2 + 2*(s.E2*s.E3-s.E0*s.E1)*m.M3
+
+		if mm := math.Sqrt(me1*me1 + me2*me2); mm > 0 {
+			me1 /= mm
+			me2 /= mm
+
+			// Known local earth field direction (bx, 0, bz), corrected for
+			// declination; only the horizontal components matter here.
+			bx := math.Cos(s.Declination)
+			by := math.Sin(s.Declination)
+
+			// Both vectors already live in the horizontal plane, so the
+			// angle between them is exactly the yaw correction needed.
+			psi := math.Atan2(me1*by-me2*bx, me1*bx+me2*by)
+
+			// Apply as a yaw-only rotation about earth-down (0,0,1)
+			s.E0, s.E1, s.E2, s.E3 = rotateYaw(s.E0, s.E1, s.E2, s.E3, psi)
+		}
+	}
+
+	if frozen {
+		// Too slow for any yaw reference (GPS course, and the accel/mag
+		// heading derived above) to be trustworthy: hold the last heading
+		// steady rather than let it drift on noise, keeping only the
+		// freshly computed roll and pitch.
+		roll, pitch, _ := s.CalcRollPitchHeading()
+		s.E0, s.E1, s.E2, s.E3 = ToQuaternion(roll, pitch, lastHeading)
 	}
+
+	// Accumulated rotations above can drift off the unit sphere; renormalize
+	// so downstream consumers always get a valid orientation quaternion.
+	enorm := math.Sqrt(s.E0*s.E0 + s.E1*s.E1 + s.E2*s.E2 + s.E3*s.E3)
+	s.E0 /= enorm
+	s.E1 /= enorm
+	s.E2 /= enorm
+	s.E3 /= enorm
+}
+
+// rotateYaw applies a yaw-only rotation of psi radians about earth-down
+// (0,0,1) to the orientation quaternion (q0,q1,q2,q3). It's the composition
+// p⊗q for p=(cos(psi/2), 0, 0, sin(psi/2)), simplified since p1=p2=0.
+func rotateYaw(q0, q1, q2, q3, psi float64) (float64, float64, float64, float64) {
+	p0, p3 := math.Cos(psi/2), math.Sin(psi/2)
+	return p0*q0 - p3*q3, p0*q1 - p3*q2, p0*q2 + p3*q1, p0*q3 + p3*q0
 }
 
 func (s *HeuristicState) Valid() (ok bool) {
 	return true
 }
 
+func (s *HeuristicState) Capabilities() Capabilities {
+	return Capabilities{
+		RequiresAccel: true,
+		RequiresMag:   false,
+		RequiresGPS:   true,
+		Params:        []string{"Kcog", "CogMinSpeed", "CogFreezeSpeed"},
+	}
+}
+
 func (s *HeuristicState) CalcRollPitchHeading() (roll float64, pitch float64, heading float64) {
 	roll, pitch, heading = FromQuaternion(s.E0, s.E1, s.E2, s.E3)
 	return
@@ -149,4 +311,4 @@ func (s *HeuristicState) CalcRollPitchHeading() (roll float64, pitch float64, he
 func (s *HeuristicState) CalcRollPitchHeadingUncertainty() (droll float64, dpitch float64, dheading float64) {
 
 	return
-}
\ No newline at end of file
+}
@@ -0,0 +1,70 @@
+package ahrs
+
+import (
+	"math"
+	"testing"
+)
+
+// TestHeuristicGyroBiasRecalibration feeds HeuristicState a parked aircraft
+// (no groundspeed, 1g on the accelerometer) with a constant gyro offset and
+// checks that the stationary detector converges GyroBias1..3 onto it.
+func TestHeuristicGyroBiasRecalibration(t *testing.T) {
+	const (
+		dt       = 0.1
+		steps    = 4000
+		trueBias = 0.02 // rad/s
+	)
+
+	s := InitializeHeuristic(&Measurement{T: 0})
+
+	for i := 1; i <= steps; i++ {
+		m := &Measurement{
+			T:      float64(i) * dt,
+			WValid: true,
+			W1:     0,
+			W2:     0,
+			W3:     0,
+			A1:     0,
+			A2:     0,
+			A3:     1,
+			B1:     trueBias,
+			B2:     trueBias,
+			B3:     trueBias,
+		}
+		s.Compute(m)
+	}
+
+	const tol = 0.002
+	if math.Abs(s.GyroBias1-trueBias) > tol || math.Abs(s.GyroBias2-trueBias) > tol || math.Abs(s.GyroBias3-trueBias) > tol {
+		t.Errorf("gyro bias recalibration: got (%f,%f,%f), want near %f",
+			s.GyroBias1, s.GyroBias2, s.GyroBias3, trueBias)
+	}
+}
+
+// TestHeuristicFreezesYawBelowCogFreezeSpeed feeds HeuristicState a near-
+// stationary GPS track whose course jitters wildly from sample to sample (as
+// a real receiver's course-over-ground does at low speed) and checks that
+// the recovered heading stays put rather than following the noise.
+func TestHeuristicFreezesYawBelowCogFreezeSpeed(t *testing.T) {
+	const steps = 100
+
+	s := InitializeHeuristic(&Measurement{T: 0})
+
+	for i := 1; i <= steps; i++ {
+		noisyCourse := float64(i) * 1.3 // rad; spins rapidly step to step
+		m := &Measurement{
+			T:      float64(i) * 0.1,
+			WValid: true,
+			W1:     0.3 * math.Cos(noisyCourse), // groundspeed well below CogFreezeSpeed
+			W2:     0.3 * math.Sin(noisyCourse),
+			A1:     0,
+			A2:     0,
+			A3:     1,
+		}
+		s.Compute(m)
+
+		if _, _, heading := s.CalcRollPitchHeading(); math.Abs(heading) > 0.01 {
+			t.Errorf("step %d: heading drifted to %f despite groundspeed below CogFreezeSpeed", i, heading)
+		}
+	}
+}
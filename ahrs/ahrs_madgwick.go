@@ -0,0 +1,176 @@
+package ahrs
+
+import (
+	"math"
+)
+
+const (
+	DefaultMadgwickBeta = 0.1 // Default filter gain, trades off gyro drift vs accel/mag noise
+)
+
+// MadgwickState implements an orientation filter using the gradient-descent
+// algorithm described by Sebastian Madgwick.  It maintains the orientation
+// quaternion E0..E3 and corrects the gyro-integrated estimate towards the
+// direction implied by the accelerometer and (if available) magnetometer.
+type MadgwickState struct {
+	State
+	Beta float64 // Feedback gain; larger values converge faster but are noisier
+}
+
+func InitializeMadgwick(m *Measurement) (s *MadgwickState) {
+	s = new(MadgwickState)
+	s.Beta = DefaultMadgwickBeta
+	s.E0 = 1
+	s.T = m.T
+	return s
+}
+
+func (s *MadgwickState) Compute(m *Measurement) {
+	dt := m.T - s.T
+
+	q0, q1, q2, q3 := s.E0, s.E1, s.E2, s.E3
+	gx, gy, gz := m.B1, m.B2, m.B3
+	ax, ay, az := m.A1, m.A2, m.A3
+
+	// Rate of change of quaternion from gyroscope
+	qDot0 := 0.5 * (-q1*gx - q2*gy - q3*gz)
+	qDot1 := 0.5 * (q0*gx + q2*gz - q3*gy)
+	qDot2 := 0.5 * (q0*gy - q1*gz + q3*gx)
+	qDot3 := 0.5 * (q0*gz + q1*gy - q2*gx)
+
+	// Compute feedback only if accelerometer measurement is valid
+	if !(ax == 0 && ay == 0 && az == 0) {
+		// Normalize accelerometer measurement
+		aNorm := 1 / math.Sqrt(ax*ax+ay*ay+az*az)
+		ax *= aNorm
+		ay *= aNorm
+		az *= aNorm
+
+		var s0, s1, s2, s3 float64
+
+		if m.MValid {
+			mx, my, mz := m.M1, m.M2, m.M3
+			mNorm := 1 / math.Sqrt(mx*mx+my*my+mz*mz)
+			mx *= mNorm
+			my *= mNorm
+			mz *= mNorm
+
+			// Auxiliary variables to avoid repeated arithmetic
+			_2q0mx := 2 * q0 * mx
+			_2q0my := 2 * q0 * my
+			_2q0mz := 2 * q0 * mz
+			_2q1mx := 2 * q1 * mx
+			_2q0 := 2 * q0
+			_2q1 := 2 * q1
+			_2q2 := 2 * q2
+			_2q3 := 2 * q3
+			_2q0q2 := 2 * q0 * q2
+			_2q2q3 := 2 * q2 * q3
+			q0q0 := q0 * q0
+			q0q1 := q0 * q1
+			q0q2 := q0 * q2
+			q0q3 := q0 * q3
+			q1q1 := q1 * q1
+			q1q2 := q1 * q2
+			q1q3 := q1 * q3
+			q2q2 := q2 * q2
+			q2q3 := q2 * q3
+			q3q3 := q3 * q3
+
+			// Reference direction of Earth's magnetic field
+			hx := mx*q0q0 - _2q0my*q3 + _2q0mz*q2 + mx*q1q1 + _2q1*my*q2 + _2q1*mz*q3 - mx*q2q2 - mx*q3q3
+			hy := _2q0mx*q3 + my*q0q0 - _2q0mz*q1 + _2q1mx*q2 - my*q1q1 + my*q2q2 + _2q2*mz*q3 - my*q3q3
+			_2bx := math.Sqrt(hx*hx + hy*hy)
+			_2bz := -_2q0mx*q2 + _2q0my*q1 + mz*q0q0 + _2q1mx*q3 - mz*q1q1 + _2q2*my*q3 - mz*q2q2 + mz*q3q3
+			_4bx := 2 * _2bx
+			_4bz := 2 * _2bz
+
+			// Gradient descent algorithm corrective step
+			s0 = -_2q2*(2*q1q3-_2q0q2-ax) + _2q1*(2*q0q1+_2q2q3-ay) -
+				_2bz*q2*(_2bx*(0.5-q2q2-q3q3)+_2bz*(q1q3-q0q2)-mx) +
+				(-_2bx*q3+_2bz*q1)*(_2bx*(q1q2-q0q3)+_2bz*(q0q1+q2q3)-my) +
+				_2bx*q2*(_2bx*(q0q2+q1q3)+_2bz*(0.5-q1q1-q2q2)-mz)
+			s1 = _2q3*(2*q1q3-_2q0q2-ax) + _2q0*(2*q0q1+_2q2q3-ay) -
+				4*q1*(1-2*q1q1-2*q2q2-az) +
+				_2bz*q3*(_2bx*(0.5-q2q2-q3q3)+_2bz*(q1q3-q0q2)-mx) +
+				(_2bx*q2+_2bz*q0)*(_2bx*(q1q2-q0q3)+_2bz*(q0q1+q2q3)-my) +
+				(_2bx*q3-_4bz*q1)*(_2bx*(q0q2+q1q3)+_2bz*(0.5-q1q1-q2q2)-mz)
+			s2 = -_2q0*(2*q1q3-_2q0q2-ax) + _2q3*(2*q0q1+_2q2q3-ay) -
+				4*q2*(1-2*q1q1-2*q2q2-az) +
+				(-_4bx*q2-_2bz*q0)*(_2bx*(0.5-q2q2-q3q3)+_2bz*(q1q3-q0q2)-mx) +
+				(_2bx*q1+_2bz*q3)*(_2bx*(q1q2-q0q3)+_2bz*(q0q1+q2q3)-my) +
+				(_2bx*q0-_4bz*q2)*(_2bx*(q0q2+q1q3)+_2bz*(0.5-q1q1-q2q2)-mz)
+			s3 = _2q1*(2*q1q3-_2q0q2-ax) + _2q2*(2*q0q1+_2q2q3-ay) +
+				(-_4bx*q3+_2bz*q1)*(_2bx*(0.5-q2q2-q3q3)+_2bz*(q1q3-q0q2)-mx) +
+				(-_2bx*q0+_2bz*q2)*(_2bx*(q1q2-q0q3)+_2bz*(q0q1+q2q3)-my) +
+				_2bx*q1*(_2bx*(q0q2+q1q3)+_2bz*(0.5-q1q1-q2q2)-mz)
+		} else {
+			// IMU-only gradient: align measured gravity with (0,0,1)
+			_2q0 := 2 * q0
+			_2q1 := 2 * q1
+			_2q2 := 2 * q2
+			_2q3 := 2 * q3
+			_4q0 := 4 * q0
+			_4q1 := 4 * q1
+			_4q2 := 4 * q2
+			_8q1 := 8 * q1
+			_8q2 := 8 * q2
+			q0q0 := q0 * q0
+			q1q1 := q1 * q1
+			q2q2 := q2 * q2
+			q3q3 := q3 * q3
+
+			s0 = _4q0*q2q2 + _2q2*ax + _4q0*q1q1 - _2q1*ay
+			s1 = _4q1*q3q3 - _2q3*ax + 4*q0q0*q1 - _2q0*ay - _4q1 + _8q1*q1q1 + _8q1*q2q2 + _4q1*az
+			s2 = 4*q0q0*q2 + _2q0*ax + _4q2*q3q3 - _2q3*ay - _4q2 + _8q2*q1q1 + _8q2*q2q2 + _4q2*az
+			s3 = 4*q1q1*q3 - _2q1*ax + 4*q2q2*q3 - _2q2*ay
+		}
+
+		sNorm := 1 / math.Sqrt(s0*s0+s1*s1+s2*s2+s3*s3)
+		s0 *= sNorm
+		s1 *= sNorm
+		s2 *= sNorm
+		s3 *= sNorm
+
+		// Apply feedback step
+		qDot0 -= s.Beta * s0
+		qDot1 -= s.Beta * s1
+		qDot2 -= s.Beta * s2
+		qDot3 -= s.Beta * s3
+	}
+
+	// Integrate rate of change of quaternion
+	q0 += qDot0 * dt
+	q1 += qDot1 * dt
+	q2 += qDot2 * dt
+	q3 += qDot3 * dt
+
+	// Normalize quaternion
+	qNorm := 1 / math.Sqrt(q0*q0+q1*q1+q2*q2+q3*q3)
+	s.E0 = q0 * qNorm
+	s.E1 = q1 * qNorm
+	s.E2 = q2 * qNorm
+	s.E3 = q3 * qNorm
+	s.T = m.T
+}
+
+func (s *MadgwickState) Valid() (ok bool) {
+	return true
+}
+
+func (s *MadgwickState) Capabilities() Capabilities {
+	return Capabilities{
+		RequiresGyro:  true,
+		RequiresAccel: true,
+		Params:        []string{"Beta"},
+	}
+}
+
+func (s *MadgwickState) CalcRollPitchHeading() (roll float64, pitch float64, heading float64) {
+	roll, pitch, heading = FromQuaternion(s.E0, s.E1, s.E2, s.E3)
+	return
+}
+
+func (s *MadgwickState) CalcRollPitchHeadingUncertainty() (droll float64, dpitch float64, dheading float64) {
+	return
+}
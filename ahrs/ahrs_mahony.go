@@ -0,0 +1,161 @@
+package ahrs
+
+import (
+	"math"
+)
+
+const (
+	DefaultMahonyKp = 0.5 // Default proportional gain on the correction error
+	DefaultMahonyKi = 0.1 // Default integral gain, drives long-term gyro bias estimate
+
+	mahonyAccelRestThreshold = 0.1  // |a|-1 beyond this means the airplane is maneuvering, not at rest
+	mahonyBiasStableTol      = 1e-3 // Per-sample gyro-bias change (rad/s) below which the estimate is considered settled
+	mahonyConvergeSamples    = 50   // Samples of a stable, near-1g accel norm and settled bias needed before Valid()
+)
+
+// MahonyState implements the Mahony explicit complementary filter: a PI
+// controller that drives the gyro-integrated quaternion towards the
+// orientation implied by gravity and (if available) the magnetic field,
+// while estimating a slowly-varying gyro bias from the integral term.
+type MahonyState struct {
+	State
+	Kp float64
+	Ki float64
+
+	RestOnlyAccel bool // If true, the accel correction is skipped while maneuvering
+
+	BX, BY, BZ float64 // Estimated gyro bias, rad/s
+
+	convergedSamples       int
+	prevBX, prevBY, prevBZ float64 // Bias estimate as of the previous sample, to detect settling
+}
+
+func InitializeMahony(m *Measurement) (s *MahonyState) {
+	s = new(MahonyState)
+	s.Kp = DefaultMahonyKp
+	s.Ki = DefaultMahonyKi
+	s.RestOnlyAccel = true
+	s.E0 = 1
+	s.T = m.T
+	return s
+}
+
+func (s *MahonyState) Compute(m *Measurement) {
+	dt := m.T - s.T
+	q0, q1, q2, q3 := s.E0, s.E1, s.E2, s.E3
+	gx, gy, gz := m.B1, m.B2, m.B3
+	ax, ay, az := m.A1, m.A2, m.A3
+
+	aNorm := math.Sqrt(ax*ax + ay*ay + az*az)
+	onRest := math.Abs(aNorm-1) < mahonyAccelRestThreshold
+
+	var ex, ey, ez float64
+	if aNorm > 0 && (!s.RestOnlyAccel || onRest) {
+		ax /= aNorm
+		ay /= aNorm
+		az /= aNorm
+
+		// Estimated gravity direction from the current quaternion, v_hat = R(q)*[0,0,1]
+		vx := 2 * (q1*q3 - q0*q2)
+		vy := 2 * (q0*q1 + q2*q3)
+		vz := q0*q0 - q1*q1 - q2*q2 + q3*q3
+
+		ex, ey, ez = ay*vz-az*vy, az*vx-ax*vz, ax*vy-ay*vx
+	}
+
+	// The mag error is gated only on its own validity, not on RestOnlyAccel:
+	// heading aiding should keep working while the accel term is rejected
+	// for maneuvering.
+	if m.MValid {
+		mx, my, mz := m.M1, m.M2, m.M3
+		mNorm := math.Sqrt(mx*mx + my*my + mz*mz)
+		if mNorm > 0 {
+			mx /= mNorm
+			my /= mNorm
+			mz /= mNorm
+
+			// Measured field rotated into the earth frame and reduced to its
+			// horizontal (bx) and vertical (bz) parts; that reference is then
+			// rotated back into the body frame (w) to get a tilt-compensated error
+			hx := 2 * (mx*(0.5-q2*q2-q3*q3) + my*(q1*q2-q0*q3) + mz*(q1*q3+q0*q2))
+			hy := 2 * (mx*(q1*q2+q0*q3) + my*(0.5-q1*q1-q3*q3) + mz*(q2*q3-q0*q1))
+			bx := math.Sqrt(hx*hx + hy*hy)
+			bz := 2 * (mx*(q1*q3-q0*q2) + my*(q2*q3+q0*q1) + mz*(0.5-q1*q1-q2*q2))
+
+			wx := 2 * (bx*(0.5-q2*q2-q3*q3) + bz*(q1*q3-q0*q2))
+			wy := 2 * (bx*(q1*q2-q0*q3) + bz*(q0*q1+q2*q3))
+			wz := 2 * (bx*(q0*q2+q1*q3) + bz*(0.5-q1*q1-q2*q2))
+
+			mex, mey, mez := my*wz-mz*wy, mz*wx-mx*wz, mx*wy-my*wx
+			ex += mex
+			ey += mey
+			ez += mez
+		}
+	}
+
+	// Integral feedback: drive the gyro bias estimate
+	if s.Ki > 0 {
+		s.BX -= s.Ki * ex * dt
+		s.BY -= s.Ki * ey * dt
+		s.BZ -= s.Ki * ez * dt
+		gx -= s.BX
+		gy -= s.BY
+		gz -= s.BZ
+	}
+
+	// Proportional feedback
+	gx += s.Kp * ex
+	gy += s.Kp * ey
+	gz += s.Kp * ez
+
+	// Integrate the corrected rate into the quaternion
+	qDot0 := 0.5 * (-q1*gx - q2*gy - q3*gz)
+	qDot1 := 0.5 * (q0*gx + q2*gz - q3*gy)
+	qDot2 := 0.5 * (q0*gy - q1*gz + q3*gx)
+	qDot3 := 0.5 * (q0*gz + q1*gy - q2*gx)
+
+	q0 += qDot0 * dt
+	q1 += qDot1 * dt
+	q2 += qDot2 * dt
+	q3 += qDot3 * dt
+
+	qNorm := 1 / math.Sqrt(q0*q0+q1*q1+q2*q2+q3*q3)
+	s.E0 = q0 * qNorm
+	s.E1 = q1 * qNorm
+	s.E2 = q2 * qNorm
+	s.E3 = q3 * qNorm
+	s.T = m.T
+
+	biasDelta := math.Sqrt((s.BX-s.prevBX)*(s.BX-s.prevBX) + (s.BY-s.prevBY)*(s.BY-s.prevBY) + (s.BZ-s.prevBZ)*(s.BZ-s.prevBZ))
+	s.prevBX, s.prevBY, s.prevBZ = s.BX, s.BY, s.BZ
+
+	if onRest && biasDelta < mahonyBiasStableTol {
+		s.convergedSamples++
+	} else {
+		s.convergedSamples = 0
+	}
+}
+
+// Valid reports false until the filter has converged: the accel norm has
+// stayed near 1g (airplane at rest) and the integral gyro-bias estimate has
+// stopped moving, both for mahonyConvergeSamples consecutive samples.
+func (s *MahonyState) Valid() (ok bool) {
+	return s.convergedSamples >= mahonyConvergeSamples
+}
+
+func (s *MahonyState) Capabilities() Capabilities {
+	return Capabilities{
+		RequiresGyro:  true,
+		RequiresAccel: true,
+		Params:        []string{"Kp", "Ki", "RestOnlyAccel"},
+	}
+}
+
+func (s *MahonyState) CalcRollPitchHeading() (roll float64, pitch float64, heading float64) {
+	roll, pitch, heading = FromQuaternion(s.E0, s.E1, s.E2, s.E3)
+	return
+}
+
+func (s *MahonyState) CalcRollPitchHeadingUncertainty() (droll float64, dpitch float64, dheading float64) {
+	return
+}
@@ -0,0 +1,69 @@
+package ahrs
+
+import (
+	"testing"
+)
+
+// TestNewStateKnownAlgorithms checks that each registered algorithm name
+// constructs a working provider that reports sane capabilities.
+func TestNewStateKnownAlgorithms(t *testing.T) {
+	for _, name := range []string{"heuristic", "madgwick", "mahony"} {
+		s, err := NewState(name, &Measurement{T: 0, A3: 1})
+		if err != nil {
+			t.Fatalf("NewState(%q): unexpected error: %v", name, err)
+		}
+
+		s.Compute(&Measurement{T: 0.01, A3: 1})
+		s.CalcRollPitchHeading()
+
+		cs, ok := s.(CapableState)
+		if !ok {
+			t.Fatalf("NewState(%q): provider does not implement CapableState", name)
+		}
+		caps := cs.Capabilities()
+		if !caps.RequiresAccel {
+			t.Errorf("NewState(%q): expected RequiresAccel, got %+v", name, caps)
+		}
+	}
+}
+
+// TestNewStateUnknownAlgorithm checks that an unregistered name errors
+// instead of silently returning something else.
+func TestNewStateUnknownAlgorithm(t *testing.T) {
+	if _, err := NewState("bogus", &Measurement{T: 0}); err == nil {
+		t.Error("NewState(\"bogus\"): expected an error, got nil")
+	}
+}
+
+// TestRunShootout checks that the shootout harness produces a roll/pitch/
+// heading trace of the right length for every named algorithm against a
+// tiny synthetic log.
+func TestRunShootout(t *testing.T) {
+	log := []Measurement{
+		{T: 0, A3: 1},
+		{T: 0.1, A3: 1},
+		{T: 0.2, A3: 1},
+	}
+
+	results, err := RunShootout([]string{"heuristic", "madgwick", "mahony"}, log)
+	if err != nil {
+		t.Fatalf("RunShootout: unexpected error: %v", err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("RunShootout: got %d results, want 3", len(results))
+	}
+	for _, r := range results {
+		if len(r.Roll) != len(log) || len(r.Pitch) != len(log) || len(r.Heading) != len(log) {
+			t.Errorf("RunShootout(%q): trace length got (%d,%d,%d), want %d",
+				r.Name, len(r.Roll), len(r.Pitch), len(r.Heading), len(log))
+		}
+	}
+}
+
+// TestRunShootoutEmptyLog checks that an empty log is rejected rather than
+// silently returning no results.
+func TestRunShootoutEmptyLog(t *testing.T) {
+	if _, err := RunShootout([]string{"heuristic"}, nil); err == nil {
+		t.Error("RunShootout with an empty log: expected an error, got nil")
+	}
+}
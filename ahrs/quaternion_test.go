@@ -0,0 +1,108 @@
+package ahrs
+
+import (
+	"math"
+	"testing"
+)
+
+const quaternionTestTol = 1e-6
+
+func assertQuaternionClose(t *testing.T, label string, q0, q1, q2, q3, e0, e1, e2, e3 float64) {
+	t.Helper()
+	if math.Abs(q0-e0) > quaternionTestTol || math.Abs(q1-e1) > quaternionTestTol ||
+		math.Abs(q2-e2) > quaternionTestTol || math.Abs(q3-e3) > quaternionTestTol {
+		t.Errorf("%s: got (%f,%f,%f,%f), want (%f,%f,%f,%f)", label, q0, q1, q2, q3, e0, e1, e2, e3)
+	}
+}
+
+func TestQuaternionAToBIdentity(t *testing.T) {
+	q0, q1, q2, q3 := QuaternionAToB(1, 0, 0, 1, 0, 0)
+	assertQuaternionClose(t, "identity", q0, q1, q2, q3, 1, 0, 0, 0)
+}
+
+func TestQuaternionAToB90DegreeRotations(t *testing.T) {
+	sqrt2over2 := math.Sqrt2 / 2
+
+	// Rotating the x axis onto the y axis is a 90 degree rotation about z.
+	q0, q1, q2, q3 := QuaternionAToB(1, 0, 0, 0, 1, 0)
+	assertQuaternionClose(t, "x->y about z", q0, q1, q2, q3, sqrt2over2, 0, 0, sqrt2over2)
+
+	// Rotating the y axis onto the z axis is a 90 degree rotation about x.
+	q0, q1, q2, q3 = QuaternionAToB(0, 1, 0, 0, 0, 1)
+	assertQuaternionClose(t, "y->z about x", q0, q1, q2, q3, sqrt2over2, sqrt2over2, 0, 0)
+
+	// Rotating the z axis onto the x axis is a 90 degree rotation about y.
+	q0, q1, q2, q3 = QuaternionAToB(0, 0, 1, 1, 0, 0)
+	assertQuaternionClose(t, "z->x about y", q0, q1, q2, q3, sqrt2over2, 0, sqrt2over2, 0)
+}
+
+func TestQuaternionRoundTrip(t *testing.T) {
+	// A known orientation: 30 deg roll, 20 deg pitch, 40 deg heading.
+	wantRoll := 30 * math.Pi / 180
+	wantPitch := 20 * math.Pi / 180
+	wantHeading := 40 * math.Pi / 180
+
+	cr, sr := math.Cos(wantRoll/2), math.Sin(wantRoll/2)
+	cp, sp := math.Cos(wantPitch/2), math.Sin(wantPitch/2)
+	ch, sh := math.Cos(wantHeading/2), math.Sin(wantHeading/2)
+
+	// Compose intrinsic heading-pitch-roll (ZYX) quaternion directly so we
+	// have ground truth to round-trip against.
+	q0 := ch*cp*cr + sh*sp*sr
+	q1 := ch*cp*sr - sh*sp*cr
+	q2 := ch*sp*cr + sh*cp*sr
+	q3 := sh*cp*cr - ch*sp*sr
+
+	roll, pitch, heading := FromQuaternion(q0, q1, q2, q3)
+	if math.Abs(roll-wantRoll) > 1e-6 || math.Abs(pitch-wantPitch) > 1e-6 || math.Abs(heading-wantHeading) > 1e-6 {
+		t.Errorf("FromQuaternion round trip: got (%f,%f,%f), want (%f,%f,%f)",
+			roll, pitch, heading, wantRoll, wantPitch, wantHeading)
+	}
+}
+
+// TestHeuristicCoordinatedTurn feeds HeuristicState a synthetic,
+// constant-rate coordinated turn and checks that the recovered heading
+// tracks the known truth trajectory, exercising the quaternion composition
+// in HeuristicState.Compute.
+func TestHeuristicCoordinatedTurn(t *testing.T) {
+	const (
+		speed    = 50.0              // m/s groundspeed
+		turnRate = 3 * math.Pi / 180 // rad/s, a standard-rate (2-minute) turn
+		dt       = 0.1
+		steps    = 50
+	)
+
+	s := InitializeHeuristic(&Measurement{T: 0})
+	heading := 0.0
+
+	for i := 1; i <= steps; i++ {
+		tNow := float64(i) * dt
+		heading += turnRate * dt
+
+		m := &Measurement{
+			T:      tNow,
+			WValid: true,
+			W1:     speed * math.Cos(heading),
+			W2:     speed * math.Sin(heading),
+			W3:     0,
+			A1:     0,
+			A2:     0,
+			A3:     1,
+		}
+		s.Compute(m)
+	}
+
+	_, _, gotHeading := s.CalcRollPitchHeading()
+
+	dPsi := gotHeading - heading
+	for dPsi > math.Pi {
+		dPsi -= 2 * math.Pi
+	}
+	for dPsi < -math.Pi {
+		dPsi += 2 * math.Pi
+	}
+
+	if math.Abs(dPsi) > 5*math.Pi/180 {
+		t.Errorf("coordinated turn heading: got %f rad, want near %f rad (diff %f)", gotHeading, heading, dPsi)
+	}
+}